@@ -10,22 +10,41 @@
 // old and new hash lists. Upon successful completion it updates saved list with
 // current state.
 //
-// Because it works by figuring out renames looking at file content hashes, it
+// Renames are primarily detected by comparing whole-file sha256 hashes, which
 // only works for files that were NOT modified between calls to this program.
+// To also cope with markdown files that were both moved and edited in the
+// same pass, each file is additionally split into content-defined chunks
+// (using a buzhash rolling hash over a 48-byte window, with boundaries placed
+// so chunks average around -chunk-size bytes), and chunks are hashed
+// individually. When a markdown file's whole-file hash has no match, its set
+// of chunk hashes is compared against every previously known file using
+// Jaccard similarity, and the closest match at or above -similarity is
+// treated as the previous name of that file, so its relative links can still
+// be resolved against its old location. Link targets are matched by
+// whole-file hash only: a link to a file that was both moved and edited is
+// not updated.
 //
 // Since it may potentially update multiple files, the whole operation is not
 // atomic, so it is advisable to only run it over files versioned by VCS, so
 // that in case of any errors original files can be easily restored.
 //
-// Currently only inline links like [link](dst.md) are supported; links like
-// [link][id] are NOT supported. The reason for this is that links are updated
-// by substring replacements inside text, this may lead to some invalid
-// replacements, and handling only inline links reduces risk of invalid
-// replacements. Please check results before committing them.
+// Both hashing files and fixing up documents are done by a pool of -j worker
+// goroutines (default: GOMAXPROCS); per-file diagnostics are buffered and
+// flushed to stderr in filepath.Walk order, so output stays deterministic
+// regardless of which worker finishes first.
+//
+// Both inline links like [link](dst.md) and reference-style links like
+// [link][id] or shortcut references like [id] are supported, as well as their
+// image counterparts. Inline links are fixed up by substring replacement
+// inside the text; reference-style links are fixed up by rewriting the
+// destination of the corresponding "[id]: dst.md" definition line instead,
+// since the link text itself never mentions the destination. Please check
+// results before committing them.
 package main
 
 import (
 	"bufio"
+	"bytes"
 	"crypto/sha256"
 	"encoding/hex"
 	"fmt"
@@ -35,7 +54,10 @@ import (
 	"net/url"
 	"os"
 	"path/filepath"
+	"runtime"
+	"sort"
 	"strings"
+	"sync"
 
 	"github.com/artyom/autoflags"
 	"github.com/gomarkdown/markdown/ast"
@@ -43,7 +65,7 @@ import (
 )
 
 func main() {
-	args := runArgs{Dir: "."}
+	args := runArgs{Dir: ".", Similarity: defaultSimilarity, ChunkSize: defaultChunkSize, J: runtime.GOMAXPROCS(0)}
 	autoflags.Parse(&args)
 	if err := run(args); err != nil {
 		os.Stderr.WriteString(err.Error() + "\n")
@@ -52,18 +74,26 @@ func main() {
 }
 
 type runArgs struct {
-	Name string `flag:"f,file to save state"`
-	Dir  string `flag:"dir,directory to scan"`
+	Name       string  `flag:"f,file to save state"`
+	Dir        string  `flag:"dir,directory to scan"`
+	Similarity float64 `flag:"similarity,minimum Jaccard similarity of chunk hash sets to treat an edited file as a rename"`
+	ChunkSize  int     `flag:"chunk-size,target chunk size in bytes for content-defined chunking"`
+	J          int     `flag:"j,number of files to process concurrently (default: GOMAXPROCS)"`
 }
 
 func run(args runArgs) error {
 	if args.Name == "" {
 		return fmt.Errorf("state file should be set")
 	}
+	workers := args.J
+	if workers < 1 {
+		workers = 1
+	}
+	ck := newChunker(args.ChunkSize)
 	hh, err := loadHashes(args.Name)
 	if os.IsNotExist(err) {
 		log.Printf("file %q not found, building one", args.Name)
-		hh, err := buildHashes(args.Dir)
+		hh, err := buildHashes(args.Dir, ck, workers)
 		if err != nil {
 			return err
 		}
@@ -76,11 +106,11 @@ func run(args runArgs) error {
 	if err != nil {
 		return err
 	}
-	hh2, err := buildHashes(args.Dir)
+	hh2, err := buildHashes(args.Dir, ck, workers)
 	if err != nil {
 		return err
 	}
-	didUpdates, err := fixDocuments(args.Dir, hh, hh2)
+	didUpdates, err := fixDocuments(args.Dir, hh, hh2, args.Similarity, workers)
 	if err != nil {
 		return err
 	}
@@ -88,7 +118,7 @@ func run(args runArgs) error {
 		return nil
 	}
 	// need to rebuild because of applied updates
-	if hh2, err = buildHashes(args.Dir); err != nil {
+	if hh2, err = buildHashes(args.Dir, ck, workers); err != nil {
 		return err
 	}
 	if err := saveHashes(hh2, args.Name); err != nil {
@@ -98,14 +128,35 @@ func run(args runArgs) error {
 	return nil
 }
 
+// stateHeader marks the first line of the current, chunk-aware state file
+// format (v2). Files saved by versions of this program that predate chunk
+// hashing have no such line and are parsed as plain "hash  name" pairs
+// instead (v1); loadHashes recognizes and loads both.
+const stateHeader = "mdmovearound-state v2"
+
 func loadHashes(name string) ([]fileHash, error) {
 	f, err := os.Open(name)
 	if err != nil {
 		return nil, err
 	}
 	defer f.Close()
+	br := bufio.NewReader(f)
+	first, err := br.ReadString('\n')
+	if err != nil && err != io.EOF {
+		return nil, err
+	}
+	if strings.TrimRight(first, "\n") == stateHeader {
+		return loadHashesV2(br)
+	}
+	if _, err := f.Seek(0, io.SeekStart); err != nil {
+		return nil, err
+	}
+	return loadHashesV1(f)
+}
+
+func loadHashesV1(r io.Reader) ([]fileHash, error) {
 	var out []fileHash
-	sc := bufio.NewScanner(f)
+	sc := bufio.NewScanner(r)
 	for sc.Scan() {
 		fields := strings.SplitN(sc.Text(), " ", 2)
 		if len(fields) != 2 {
@@ -122,6 +173,36 @@ func loadHashes(name string) ([]fileHash, error) {
 	return out, nil
 }
 
+func loadHashesV2(r io.Reader) ([]fileHash, error) {
+	var out []fileHash
+	cur := -1
+	sc := bufio.NewScanner(r)
+	sc.Buffer(make([]byte, 64<<10), 16<<20)
+	for sc.Scan() {
+		line := sc.Text()
+		switch {
+		case strings.HasPrefix(line, "H "):
+			fields := strings.SplitN(line[len("H "):], " ", 2)
+			if len(fields) != 2 {
+				return nil, fmt.Errorf("invalid line: %q", line)
+			}
+			out = append(out, fileHash{Hash: fields[0], Name: fields[1]})
+			cur = len(out) - 1
+		case strings.HasPrefix(line, "C "):
+			if cur < 0 {
+				return nil, fmt.Errorf("chunk line with no preceding file: %q", line)
+			}
+			out[cur].Chunks = strings.Fields(line[len("C "):])
+		default:
+			return nil, fmt.Errorf("invalid line: %q", line)
+		}
+	}
+	if err := sc.Err(); err != nil {
+		return nil, err
+	}
+	return out, nil
+}
+
 func saveHashes(hh []fileHash, name string) error {
 	tf, err := ioutil.TempFile(filepath.Dir(name), ".mdmovearound-")
 	if err != nil {
@@ -129,10 +210,18 @@ func saveHashes(hh []fileHash, name string) error {
 	}
 	defer tf.Close()
 	defer os.Remove(tf.Name())
+	if _, err := fmt.Fprintln(tf, stateHeader); err != nil {
+		return err
+	}
 	for _, fh := range hh {
-		if _, err := fmt.Fprintln(tf, fh); err != nil {
+		if _, err := fmt.Fprintf(tf, "H %s %s\n", fh.Hash, fh.Name); err != nil {
 			return err
 		}
+		if len(fh.Chunks) > 0 {
+			if _, err := fmt.Fprintf(tf, "C %s\n", strings.Join(fh.Chunks, " ")); err != nil {
+				return err
+			}
+		}
 	}
 	if err := tf.Close(); err != nil {
 		return err
@@ -140,11 +229,11 @@ func saveHashes(hh []fileHash, name string) error {
 	return os.Rename(tf.Name(), name)
 }
 
-func buildHashes(dir string) ([]fileHash, error) {
+func buildHashes(dir string, ck *chunker, workers int) ([]fileHash, error) {
 	if dir == "" {
 		return nil, fmt.Errorf("dir must not be empty")
 	}
-	var out []fileHash
+	var paths []string
 	err := filepath.Walk(dir, func(path string, info os.FileInfo, err error) error {
 		if err != nil {
 			return err
@@ -156,40 +245,64 @@ func buildHashes(dir string) ([]fileHash, error) {
 		if !info.Mode().IsRegular() || strings.HasPrefix(base, ".") {
 			return nil
 		}
-		h, err := buildFileHash(path)
-		if err != nil {
-			return err
-		}
-		out = append(out, fileHash{Name: path, Hash: hex.EncodeToString(h)})
+		paths = append(paths, path)
 		return nil
 	})
 	if err != nil {
 		return nil, err
 	}
+	if workers < 1 {
+		workers = 1
+	}
+	out := make([]fileHash, len(paths))
+	errs := make([]error, len(paths))
+	jobs := make(chan int)
+	var wg sync.WaitGroup
+	for i := 0; i < workers; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for idx := range jobs {
+				h, chunks, err := buildFileHash(paths[idx], ck)
+				if err != nil {
+					errs[idx] = err
+					continue
+				}
+				out[idx] = fileHash{Name: paths[idx], Hash: hex.EncodeToString(h), Chunks: chunks}
+			}
+		}()
+	}
+	for i := range paths {
+		jobs <- i
+	}
+	close(jobs)
+	wg.Wait()
+	for _, err := range errs {
+		if err != nil {
+			return nil, err
+		}
+	}
 	return out, nil
 }
 
 type fileHash struct {
-	Name string
-	Hash string
+	Name   string
+	Hash   string
+	Chunks []string // sha256 hex digests of content-defined chunks, in order
 }
 
 func (fh fileHash) String() string { return fh.Hash + "  " + fh.Name }
 
-func buildFileHash(name string) ([]byte, error) {
-	f, err := os.Open(name)
+func buildFileHash(name string, ck *chunker) (sum []byte, chunks []string, err error) {
+	b, err := ioutil.ReadFile(name)
 	if err != nil {
-		return nil, err
+		return nil, nil, err
 	}
-	defer f.Close()
-	h := sha256.New()
-	if _, err := io.Copy(h, f); err != nil {
-		return nil, err
-	}
-	return h.Sum(nil), nil
+	h := sha256.Sum256(b)
+	return h[:], ck.split(b), nil
 }
 
-func fixDocuments(dir string, oldHashes, newHashes []fileHash) (bool, error) {
+func fixDocuments(dir string, oldHashes, newHashes []fileHash, similarity float64, workers int) (bool, error) {
 	oldFileToHash := make(map[string]string, len(oldHashes))
 	oldHashToFile := make(map[string]string, len(oldHashes))
 	for _, fh := range oldHashes {
@@ -197,41 +310,98 @@ func fixDocuments(dir string, oldHashes, newHashes []fileHash) (bool, error) {
 		oldHashToFile[fh.Hash] = fh.Name
 	}
 	hashToFile := make(map[string]string, len(newHashes))
+	newByName := make(map[string]fileHash, len(newHashes))
 	for _, fh := range newHashes {
 		hashToFile[fh.Hash] = fh.Name
+		newByName[fh.Name] = fh
 	}
-	var didUpdates bool
+	var mdNames []string
 	for _, fh := range newHashes {
-		if !strings.HasSuffix(fh.Name, ".md") {
-			continue
+		if strings.HasSuffix(fh.Name, ".md") {
+			mdNames = append(mdNames, fh.Name)
 		}
-		ok, err := processFile(fh.Name, oldFileToHash, oldHashToFile, hashToFile)
-		if err != nil {
-			return didUpdates, err
+	}
+
+	if workers < 1 {
+		workers = 1
+	}
+	type result struct {
+		lines   []string
+		changed bool
+		err     error
+	}
+	results := make([]result, len(mdNames))
+	jobs := make(chan int)
+	var wg sync.WaitGroup
+	for i := 0; i < workers; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for idx := range jobs {
+				name := mdNames[idx]
+				lines, changed, err := processFile(name, newByName[name].Chunks, oldHashes, oldFileToHash, oldHashToFile, hashToFile, similarity)
+				results[idx] = result{lines: lines, changed: changed, err: err}
+			}
+		}()
+	}
+	for i := range mdNames {
+		jobs <- i
+	}
+	close(jobs)
+	wg.Wait()
+
+	var didUpdates bool
+	for _, r := range results {
+		flushDiag(r.lines)
+		if r.err != nil {
+			return didUpdates, r.err
 		}
-		if ok {
+		if r.changed {
 			didUpdates = true
 		}
 	}
 	return didUpdates, nil
 }
 
-func processFile(name string, oldFileToHash, oldHashToFile, hashToFile map[string]string) (bool, error) {
+// flushDiag writes buffered per-file diagnostic lines to stderr, in the
+// format log.Printf would have used (log.SetFlags(0) leaves no prefix).
+func flushDiag(lines []string) {
+	for _, l := range lines {
+		fmt.Fprintln(os.Stderr, l)
+	}
+}
+
+// processFile checks and fixes up a single document's links, returning
+// diagnostic lines to print rather than printing them directly, so a pool of
+// worker goroutines can all call it concurrently without interleaving their
+// output.
+func processFile(name string, selfChunks []string, oldHashes []fileHash, oldFileToHash, oldHashToFile, hashToFile map[string]string, similarity float64) (lines []string, changed bool, err error) {
+	diag := func(format string, args ...interface{}) {
+		lines = append(lines, fmt.Sprintf(format, args...))
+	}
 	b, err := ioutil.ReadFile(name)
 	if os.IsNotExist(err) {
-		return false, nil
+		return nil, false, nil
 	}
 	if err != nil {
-		return false, err
+		return nil, false, err
 	}
 	sum := sha256.Sum256(b)
 	selfHash := hex.EncodeToString(sum[:])
 	oldName := oldHashToFile[selfHash]
 	if oldName == "" {
-		log.Printf("cannot figure out old name for %q (%s), skipping", name, selfHash)
-		return false, nil
+		if oldName = bestChunkMatch(oldHashes, selfChunks, similarity); oldName != "" {
+			diag("%s: content changed, matched to previous name %q by chunk similarity", name, oldName)
+		}
 	}
+	if oldName == "" {
+		diag("cannot figure out old name for %q (%s), skipping", name, selfHash)
+		return lines, false, nil
+	}
+	defs := parseRefDefs(b)
 	var repl []string
+	var defEdits []defEdit
+	defEdited := make(map[*refDef]bool)
 	doc := parser.NewWithExtensions(extensions).Parse(b)
 	walkFn := func(node ast.Node, entering bool) ast.WalkStatus {
 		if !entering {
@@ -273,22 +443,38 @@ func processFile(name string, oldFileToHash, oldHashToFile, hashToFile map[strin
 		}
 		newName, err := filepath.Rel(filepath.Dir(name), candidate)
 		if err != nil {
-			log.Printf("%s: filepath.Rel(%q, %q): %v", name, filepath.Dir(name), candidate, err)
+			diag("%s: filepath.Rel(%q, %q): %v", name, filepath.Dir(name), candidate, err)
 			return ast.GoToNext
 		}
 		u2 := &url.URL{Fragment: u.Fragment, Path: filepath.ToSlash(newName)}
-		// below dst is used instead of u.String() because we need to
-		// keep exact same way link is written in text
-		repl = append(repl, "("+escaper.Replace(dst)+")", "("+escaper.Replace(u2.String())+")")
-		log.Printf("%s: broken link replacement: %q -> %q", name, u, u2)
+		if inlineToken := "(" + escaper.Replace(dst) + ")"; bytes.Contains(b, []byte(inlineToken)) {
+			// below dst is used instead of u.String() because we need to
+			// keep exact same way link is written in text
+			repl = append(repl, inlineToken, "("+escaper.Replace(u2.String())+")")
+			diag("%s: broken link replacement: %q -> %q", name, u, u2)
+			return ast.GoToNext
+		}
+		// No "(dst)" occurrence means this is a reference-style or
+		// shortcut link/image; find every definition that supplies this
+		// destination and patch them all up, since more than one
+		// reference can share a definition with the same destination.
+		for _, d := range findRefDefs(defs, dst) {
+			if defEdited[d] {
+				continue
+			}
+			defEdited[d] = true
+			defEdits = append(defEdits, defEdit{def: d, dst: u2.String()})
+			diag("%s: broken reference link [%s]: %q -> %q", name, d.label, u, u2)
+		}
 		return ast.GoToNext
 	}
 	_ = ast.Walk(doc, ast.NodeVisitorFunc(walkFn))
-	if len(repl) == 0 {
-		return false, nil
+	if len(repl) == 0 && len(defEdits) == 0 {
+		return lines, false, nil
 	}
+	b2 := applyDefEdits(b, defEdits)
 	r := strings.NewReplacer(repl...)
-	return true, ioutil.WriteFile(name, []byte(r.Replace(string(b))), 0666)
+	return lines, true, ioutil.WriteFile(name, []byte(r.Replace(string(b2))), 0666)
 }
 
 func fileOrDirExists(name string) bool {
@@ -312,6 +498,294 @@ var escaper = strings.NewReplacer(
 	`)`, `\)`,
 )
 
+// refDef describes a single reference-style link definition line, e.g.
+//
+//	[id]: dst.md "title"
+//
+// dstStart/dstEnd are byte offsets of the destination token within the
+// original file content. For an angle-bracketed destination they span the
+// surrounding "<" ">" pair; dst itself is always unwrapped.
+type refDef struct {
+	label       string // normalized label, as used to look up [id] / [id][] / [text][id]
+	dst         string // destination exactly as written, with <...> unwrapped
+	dstStart    int
+	dstEnd      int
+	angleBraced bool // destination was written wrapped in <...>
+}
+
+// defEdit describes a pending rewrite of a single reference definition's
+// destination.
+type defEdit struct {
+	def *refDef
+	dst string
+}
+
+// applyDefEdits rewrites the destination tokens of b described by edits,
+// leaving everything else - including labels and titles - untouched.
+func applyDefEdits(b []byte, edits []defEdit) []byte {
+	if len(edits) == 0 {
+		return b
+	}
+	sort.Slice(edits, func(i, j int) bool { return edits[i].def.dstStart < edits[j].def.dstStart })
+	var out bytes.Buffer
+	pos := 0
+	for _, e := range edits {
+		out.Write(b[pos:e.def.dstStart])
+		dst := e.dst
+		if e.def.angleBraced || strings.ContainsAny(dst, " \t") {
+			dst = "<" + dst + ">"
+		}
+		out.WriteString(dst)
+		pos = e.def.dstEnd
+	}
+	out.Write(b[pos:])
+	return out.Bytes()
+}
+
+// findRefDefs returns every definition whose destination matches dst. More
+// than one reference can point at the same moved file (e.g. a link and an
+// image sharing one definition, or two distinct [id]: lines with identical
+// destinations), and all of them need to move to the same new destination.
+func findRefDefs(defs []*refDef, dst string) []*refDef {
+	var found []*refDef
+	for _, d := range defs {
+		if d.dst == dst {
+			found = append(found, d)
+		}
+	}
+	return found
+}
+
+// parseRefDefs scans b for link reference definitions of the form
+//
+//	[label]: destination "optional title"
+//
+// using a small line-oriented tokenizer rather than a regexp, so that
+// destinations and titles containing brackets, quotes or parentheses aren't
+// mangled. Only definitions whose destination is on the same line as the
+// label are recognized. Nothing after the destination is parsed, so a title
+// (including one that continues on following lines) is left as it is.
+func parseRefDefs(b []byte) []*refDef {
+	var defs []*refDef
+	for lineStart := 0; lineStart <= len(b); {
+		nl := bytes.IndexByte(b[lineStart:], '\n')
+		lineEnd := len(b)
+		if nl >= 0 {
+			lineEnd = lineStart + nl
+		}
+		if d := parseRefDefLine(b[lineStart:lineEnd], lineStart); d != nil {
+			defs = append(defs, d)
+		}
+		if nl < 0 {
+			break
+		}
+		lineStart = lineEnd + 1
+	}
+	return defs
+}
+
+func parseRefDefLine(line []byte, base int) *refDef {
+	i := 0
+	for i < len(line) && line[i] == ' ' {
+		i++
+	}
+	if i > 3 || i >= len(line) || line[i] != '[' {
+		return nil
+	}
+	i++
+	labelStart := i
+	for i < len(line) {
+		switch line[i] {
+		case '\\':
+			i += 2
+			continue
+		case ']':
+		default:
+			i++
+			continue
+		}
+		break
+	}
+	if i >= len(line) || line[i] != ']' || i == labelStart {
+		return nil
+	}
+	label := string(line[labelStart:i])
+	i++
+	if i >= len(line) || line[i] != ':' {
+		return nil
+	}
+	i++
+	for i < len(line) && (line[i] == ' ' || line[i] == '\t') {
+		i++
+	}
+	if i >= len(line) {
+		return nil
+	}
+	d := &refDef{label: normalizeRefLabel(label)}
+	if line[i] == '<' {
+		start := i + 1
+		j := start
+		for j < len(line) && line[j] != '>' {
+			j++
+		}
+		if j >= len(line) {
+			return nil
+		}
+		d.dst = string(line[start:j])
+		d.dstStart, d.dstEnd = base+i, base+j+1
+		d.angleBraced = true
+		i = j + 1
+	} else {
+		start := i
+		for i < len(line) && line[i] != ' ' && line[i] != '\t' {
+			i++
+		}
+		d.dst = string(line[start:i])
+		d.dstStart, d.dstEnd = base+start, base+i
+	}
+	return d
+}
+
+// normalizeRefLabel implements the CommonMark rule that link labels are
+// matched case-insensitively, with consecutive internal whitespace collapsed.
+func normalizeRefLabel(label string) string {
+	return strings.ToLower(strings.Join(strings.Fields(label), " "))
+}
+
+const (
+	defaultChunkSize  = 8 << 10 // 8KiB, middle of the 4-16KiB target range
+	defaultSimilarity = 0.6
+	chunkWindow       = 48 // buzhash rolling window, in bytes
+)
+
+// chunker splits file content into content-defined chunks using a buzhash
+// rolling hash: a chunk boundary falls wherever the low bits of the hash of
+// the last chunkWindow bytes are all zero, which places boundaries at
+// positions determined by local content rather than by a fixed offset, so
+// chunks realign after an insertion or deletion elsewhere in the file.
+type chunker struct {
+	mask     uint64
+	min, max int
+}
+
+// newChunker returns a chunker targeting an average chunk size of avgSize
+// bytes, bounded to roughly a quarter and four times that size so neither
+// pathological input nor very uniform input produces degenerate chunks.
+func newChunker(avgSize int) *chunker {
+	if avgSize <= 0 {
+		avgSize = defaultChunkSize
+	}
+	var bits uint
+	for 1<<bits < avgSize {
+		bits++
+	}
+	min, max := avgSize/4, avgSize*4
+	if min < chunkWindow {
+		min = chunkWindow
+	}
+	return &chunker{mask: 1<<bits - 1, min: min, max: max}
+}
+
+// split returns the sha256 digests, hex-encoded, of each chunk of b.
+func (c *chunker) split(b []byte) []string {
+	if len(b) == 0 {
+		return nil
+	}
+	var chunks []string
+	start := 0
+	var h uint64
+	for i, v := range b {
+		h = rol(h, 1) ^ buzTable[v]
+		if drop := i - chunkWindow; drop >= start {
+			h ^= rol(buzTable[b[drop]], chunkWindow%64)
+		}
+		if n := i - start + 1; n >= c.min && (h&c.mask == 0 || n >= c.max) {
+			chunks = append(chunks, sumHex(b[start:i+1]))
+			start = i + 1
+			h = 0
+		}
+	}
+	if start < len(b) {
+		chunks = append(chunks, sumHex(b[start:]))
+	}
+	return chunks
+}
+
+func sumHex(b []byte) string {
+	sum := sha256.Sum256(b)
+	return hex.EncodeToString(sum[:])
+}
+
+func rol(x uint64, n uint) uint64 { return x<<(n%64) | x>>(64-n%64) }
+
+// buzTable holds the per-byte random values used by the buzhash rolling
+// hash. It must stay fixed across runs of the program: chunk boundaries (and
+// thus the resulting chunk digests) are only comparable across two runs if
+// they were computed with the same table, so this is generated once with a
+// fixed seed rather than from a random source.
+var buzTable = genBuzTable()
+
+func genBuzTable() [256]uint64 {
+	var t [256]uint64
+	x := uint64(0x9e3779b97f4a7c15)
+	for i := range t {
+		x += 0x9e3779b97f4a7c15
+		z := x
+		z = (z ^ (z >> 30)) * 0xbf58476d1ce4e5b9
+		z = (z ^ (z >> 27)) * 0x94d049bb133111eb
+		z ^= z >> 31
+		t[i] = z
+	}
+	return t
+}
+
+// bestChunkMatch returns the name of the old file whose chunk set has the
+// highest Jaccard similarity to chunks, provided it is at or above
+// threshold. It returns "" if there is no such file.
+func bestChunkMatch(oldHashes []fileHash, chunks []string, threshold float64) string {
+	if len(chunks) == 0 {
+		return ""
+	}
+	var bestName string
+	var bestScore float64
+	for _, oh := range oldHashes {
+		if len(oh.Chunks) == 0 {
+			continue
+		}
+		if score := jaccard(chunks, oh.Chunks); score >= threshold && score > bestScore {
+			bestScore, bestName = score, oh.Name
+		}
+	}
+	return bestName
+}
+
+// jaccard returns the Jaccard similarity of the sets of strings in a and b:
+// the size of their intersection divided by the size of their union.
+func jaccard(a, b []string) float64 {
+	if len(a) == 0 || len(b) == 0 {
+		return 0
+	}
+	as := make(map[string]struct{}, len(a))
+	for _, s := range a {
+		as[s] = struct{}{}
+	}
+	bs := make(map[string]struct{}, len(b))
+	for _, s := range b {
+		bs[s] = struct{}{}
+	}
+	var inter int
+	for s := range bs {
+		if _, ok := as[s]; ok {
+			inter++
+		}
+	}
+	union := len(as) + len(bs) - inter
+	if union == 0 {
+		return 0
+	}
+	return float64(inter) / float64(union)
+}
+
 const extensions = parser.CommonExtensions | parser.AutoHeadingIDs ^ parser.MathJax
 
 func init() {
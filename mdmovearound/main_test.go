@@ -0,0 +1,61 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+// TestFixDocumentsMultipleRefsToSameDef covers a moved file reached through
+// two distinct reference definitions with the same destination: a link uses
+// one and an image uses the other. Both definitions must be repointed, not
+// just the first one encountered.
+func TestFixDocumentsMultipleRefsToSameDef(t *testing.T) {
+	dir := t.TempDir()
+	const oldContent = "hello\n"
+	if err := os.WriteFile(filepath.Join(dir, "old.md"), []byte(oldContent), 0666); err != nil {
+		t.Fatal(err)
+	}
+	const docContent = "See [text][t] and ![img][i].\n\n" +
+		"[t]: old.md \"Title\"\n" +
+		"[i]: old.md\n"
+	if err := os.WriteFile(filepath.Join(dir, "doc.md"), []byte(docContent), 0666); err != nil {
+		t.Fatal(err)
+	}
+	ck := newChunker(defaultChunkSize)
+	oldHashes, err := buildHashes(dir, ck, 1)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if err := os.Mkdir(filepath.Join(dir, "sub"), 0777); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Rename(filepath.Join(dir, "old.md"), filepath.Join(dir, "sub", "new.md")); err != nil {
+		t.Fatal(err)
+	}
+	newHashes, err := buildHashes(dir, ck, 1)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	changed, err := fixDocuments(dir, oldHashes, newHashes, defaultSimilarity, 1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !changed {
+		t.Fatal("fixDocuments reported no changes")
+	}
+
+	got, err := os.ReadFile(filepath.Join(dir, "doc.md"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if strings.Contains(string(got), "old.md") {
+		t.Errorf("doc.md still references old.md:\n%s", got)
+	}
+	if n := strings.Count(string(got), "sub/new.md"); n != 2 {
+		t.Errorf("doc.md has %d references to sub/new.md, want 2:\n%s", n, got)
+	}
+}
@@ -20,119 +20,299 @@
 // If markdown file has any embedded html, this tool also parses such html
 // taking into account all name or id attributes on html tags.
 //
+// Since resolving a file.md#id link requires parsing the target file just to
+// collect its heading/HTML ids, the -cache flag can be used to persist those
+// ids (and the file's own outbound links) to disk, keyed by file path and
+// checked against the file's content hash; on later runs a link target whose
+// hash hasn't changed since the previous run is not re-parsed to resolve
+// fragments. Files being checked are always parsed to find their links.
+//
+// Each directory argument is processed by a pool of -j worker goroutines
+// (default: GOMAXPROCS), one file at a time; per-file diagnostics are
+// buffered and collected in the same order filepath.Walk would have visited
+// the files in, so output remains deterministic regardless of which worker
+// happens to finish first.
+//
+// The -format flag selects how diagnostics are reported: "text" (the
+// default) prints one human-readable line per diagnostic to stderr; "json"
+// prints one JSON object per diagnostic (file, line, column, destination,
+// kind) to stdout, for easy consumption by other tools; "sarif" prints a
+// single SARIF 2.1.0 log to stdout, for CI systems that understand that
+// format natively.
+//
+// Destinations are checked by a Resolver, chosen per-link from a small
+// built-in registry. Relative, schemeless destinations are always checked
+// against the local filesystem. The -anchors flag names a JSON manifest
+// (path -> list of extra ids) for projects whose heading ids come from a
+// downstream renderer such as Hugo or docsify rather than gomarkdown's
+// AutoHeadingIDs; its ids are unioned with whatever gomarkdown finds.
+// http(s) destinations are otherwise ignored, unless their host appears in
+// the comma-separated -check-external list, in which case they're checked
+// with real HTTP requests (HEAD for existence, ETag-cached GET to harvest
+// fragment ids) - the -external-cache flag persists that cache to disk the
+// same way -cache does for local files.
+//
 // Program reports any errors on stderr and exits with non-zero exit code.
 package main
 
 import (
 	"bytes"
-	"errors"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"flag"
 	"fmt"
+	"io"
 	"io/ioutil"
 	"log"
+	"net/http"
 	"net/url"
 	"os"
 	"path/filepath"
+	"runtime"
+	"sort"
 	"strings"
+	"sync"
+	"time"
 	"unicode/utf8"
 
+	"github.com/artyom/autoflags"
 	"github.com/gomarkdown/markdown/ast"
 	"github.com/gomarkdown/markdown/parser"
 	"golang.org/x/net/html"
 	"golang.org/x/net/html/atom"
 )
 
+type runArgs struct {
+	Cache         string `flag:"cache,path to persistent link/ref cache file"`
+	J             int    `flag:"j,number of files to check concurrently (default: GOMAXPROCS)"`
+	Format        string `flag:"format,output format: text, json, or sarif"`
+	Anchors       string `flag:"anchors,path to JSON manifest of path to extra fragment ids, for ids assigned by a downstream renderer"`
+	CheckExternal string `flag:"check-external,comma-separated list of external hosts to verify with HTTP requests"`
+	ExternalCache string `flag:"external-cache,path to persistent cache file for the external HTTP resolver"`
+}
+
 func main() {
-	if len(os.Args) < 2 {
-		log.Fatalf("usage: %s file.md|directory ...", filepath.Base(os.Args[0]))
+	args := runArgs{J: runtime.GOMAXPROCS(0), Format: "text"}
+	autoflags.Parse(&args)
+	switch args.Format {
+	case "text", "json", "sarif":
+	default:
+		log.Fatalf("unknown -format %q, want one of: text, json, sarif", args.Format)
 	}
-	var exitCode int
-	intrefs := make(refMap)
-	for _, name := range os.Args[1:] {
-		if err := run(name, intrefs); err != nil {
-			if err == errDirtyRun {
-				exitCode = 1
-				continue
+	names := flag.Args()
+	if len(names) == 0 {
+		log.Fatalf("usage: %s [flags] file.md|directory ...", filepath.Base(os.Args[0]))
+	}
+	cache, err := loadLinkCache(args.Cache)
+	if err != nil {
+		log.Fatal(err)
+	}
+	anchors, err := loadAnchorsManifest(args.Anchors)
+	if err != nil {
+		log.Fatal(err)
+	}
+	reg := &resolverRegistry{anchors: anchors}
+	var extCache *etagCache
+	if args.CheckExternal != "" {
+		extCache, err = loadEtagCache(args.ExternalCache)
+		if err != nil {
+			log.Fatal(err)
+		}
+		reg.external = newHTTPResolver(extCache)
+		reg.hosts = make(map[string]bool)
+		for _, h := range strings.Split(args.CheckExternal, ",") {
+			if h = strings.TrimSpace(h); h != "" {
+				reg.hosts[h] = true
 			}
+		}
+	}
+	workers := args.J
+	if workers < 1 {
+		workers = 1
+	}
+	var diags []diagnostic
+	intrefs := newSafeRefMap()
+	for _, name := range names {
+		d, err := run(name, intrefs, cache, reg, workers)
+		diags = append(diags, d...)
+		if err != nil {
 			log.Fatal(err)
 		}
 	}
+	if err := cache.save(); err != nil {
+		log.Printf("saving cache: %v", err)
+	}
+	if err := extCache.save(); err != nil {
+		log.Printf("saving external cache: %v", err)
+	}
+	if err := emit(args.Format, diags); err != nil {
+		log.Fatal(err)
+	}
+	var exitCode int
+	for _, d := range diags {
+		if d.Fails {
+			exitCode = 1
+			break
+		}
+	}
 	os.Exit(exitCode)
 }
 
-func run(name string, intrefs refMap) error {
+func run(name string, intrefs *safeRefMap, cache *linkCache, reg *resolverRegistry, workers int) ([]diagnostic, error) {
 	fi, err := os.Stat(name)
 	if err != nil {
-		return err
+		return nil, err
 	}
 	if !fi.IsDir() {
-		return processFile(name, intrefs)
+		return processFile(name, intrefs, cache, reg)
 	}
-	var outErr error
-	err = filepath.Walk(name, func(name string, fi os.FileInfo, err error) error {
+
+	var names []string
+	err = filepath.Walk(name, func(p string, fi os.FileInfo, err error) error {
 		if err != nil {
 			return err
 		}
-		if base := filepath.Base(name); fi.IsDir() && base != "." && strings.HasPrefix(base, ".") {
+		if base := filepath.Base(p); fi.IsDir() && base != "." && strings.HasPrefix(base, ".") {
 			return filepath.SkipDir
 		}
-		if fi.IsDir() || !strings.HasSuffix(name, ".md") {
-			return nil
-		}
-		if err = processFile(name, intrefs); err == errDirtyRun {
-			outErr = err
+		if fi.IsDir() || !strings.HasSuffix(p, ".md") {
 			return nil
 		}
-		return err
+		names = append(names, p)
+		return nil
 	})
 	if err != nil {
-		return err
+		return nil, err
+	}
+
+	type result struct {
+		diags []diagnostic
+		err   error
 	}
-	return outErr
+	results := make([]result, len(names))
+	jobs := make(chan int)
+	var wg sync.WaitGroup
+	for i := 0; i < workers; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for idx := range jobs {
+				d, err := processFile(names[idx], intrefs, cache, reg)
+				results[idx] = result{diags: d, err: err}
+			}
+		}()
+	}
+	for i := range names {
+		jobs <- i
+	}
+	close(jobs)
+	wg.Wait()
+
+	// Collect diagnostics, and only then inspect errors, so output order
+	// matches the order filepath.Walk visited files in regardless of
+	// worker scheduling.
+	var diags []diagnostic
+	var outErr error
+	for _, r := range results {
+		diags = append(diags, r.diags...)
+		if r.err != nil && outErr == nil {
+			outErr = r.err
+		}
+	}
+	return diags, outErr
+}
+
+// diagKind classifies a diagnostic for the benefit of the -format json and
+// -format sarif outputs; it has no effect on -format text.
+type diagKind string
+
+const (
+	kindBrokenFile     diagKind = "broken-file"
+	kindBrokenFragment diagKind = "broken-fragment"
+	kindUnstableSlug   diagKind = "unstable-slug"
+)
+
+// diagnostic is a single finding from processFile. Line and Column are
+// 1-based and refer to the first occurrence of Destination's text in the
+// file's raw bytes (for a reference-style link that is usually its
+// definition line); they're left zero when Destination is empty or its text
+// can't be located.
+type diagnostic struct {
+	File        string
+	Line        int
+	Column      int
+	Destination string
+	Kind        diagKind
+	Message     string
+	Fails       bool // whether this diagnostic should affect the exit code
 }
 
-func processFile(name string, intrefs refMap) error {
+// processFile checks a single markdown file's links and returns the
+// diagnostics produced, rather than printing them directly, so a pool of
+// worker goroutines can all call it concurrently without interleaving their
+// output.
+func processFile(name string, intrefs *safeRefMap, cache *linkCache, reg *resolverRegistry) (diags []diagnostic, err error) {
 	b, err := ioutil.ReadFile(name)
 	if err != nil {
-		return err
+		return nil, err
 	}
 	doc := parser.NewWithExtensions(extensions).Parse(b)
 
-	idRefs := extractRefs(doc)
-	var hadErrors bool
+	docRefs := extractRefs(doc)
+	cache.put(name, b, docRefs, extractLinks(doc))
+	idRefs := mergeIDs(docRefs, reg.anchors[name])
+	li := newLineIndex(b)
+	report := func(kind diagKind, dst string, fails bool, format string, args ...interface{}) {
+		var line, col int
+		if dst != "" {
+			if off := bytes.Index(b, []byte(dst)); off >= 0 {
+				line, col = li.lineCol(off)
+			}
+		}
+		diags = append(diags, diagnostic{
+			File: name, Line: line, Column: col, Destination: dst, Kind: kind,
+			Message: fmt.Sprintf(format, args...), Fails: fails,
+		})
+	}
 	walkFn := func(node ast.Node, entering bool) ast.WalkStatus {
 		if !entering {
 			return ast.GoToNext
 		}
-		var exists func(string) bool = fileOrDirExists
+		var isImage bool
 		var dst string
 		switch n := node.(type) {
 		case *ast.Link:
 			dst = string(n.Destination)
 		case *ast.Image:
-			exists = fileExists
+			isImage = true
 			dst = string(n.Destination)
 		default:
 			return ast.GoToNext
 		}
 		if dst == "" {
-			log.Printf("%s: empty url", name)
+			report(kindBrokenFile, dst, false, "%s: empty url", name)
 			return ast.GoToNext
 		}
 		u, err := url.Parse(dst)
 		if err != nil {
-			log.Printf("%s: %q: %v", name, dst, err)
-			hadErrors = true
+			report(kindBrokenFile, dst, true, "%s: %q: %v", name, dst, err)
 			return ast.GoToNext
 		}
 		if u.Scheme == "" && u.Host == "" && u.Path == "" && u.Fragment != "" {
 			if _, ok := idRefs[u.Fragment]; !ok {
-				hadErrors = true
-				log.Printf("%s: %q: broken link", name, dst)
+				report(kindBrokenFragment, dst, true, "%s: %q: broken link", name, dst)
 			} else if unstableRef(u.Fragment, idRefs) {
-				log.Printf(unstableSlugFormat, name, dst)
+				report(kindUnstableSlug, dst, false, unstableSlugFormat, name, dst)
+			}
+		}
+		if u.Scheme != "" || u.Host != "" {
+			if res := reg.forURL(u); res != nil {
+				checkResolved(res, u, name, dst, dst, report)
 			}
+			return ast.GoToNext
 		}
-		if u.Scheme != "" || u.Host != "" || u.Path == "" {
+		if u.Path == "" {
 			return ast.GoToNext
 		}
 
@@ -143,32 +323,64 @@ func processFile(name string, intrefs refMap) error {
 			filename = filepath.Join(filepath.Dir(name), filepath.FromSlash(u.Path))
 		}
 
-		if !exists(filename) {
-			hadErrors = true
-			log.Printf("%s: %q: broken link", name, dst)
-		}
-		if u.Fragment != "" && strings.HasSuffix(filename, ".md") {
-			okf, okr := intrefs.hasRef(filename, u.Fragment)
-			if !okf {
-				if r, err := fileRefs(filename); err == nil {
-					intrefs.setRefs(filename, r)
-					_, okr = r[u.Fragment]
-				}
-			}
-			if !okr {
-				hadErrors = true
-				log.Printf("%s: %q: broken link (fragment points to non-existent id)", name, dst)
-			} else if unstableRef(u.Fragment, intrefs[filename]) {
-				log.Printf(unstableSlugFormat, name, dst)
-			}
-		}
+		res := reg.forLocal(intrefs, cache, isImage)
+		checkResolved(res, u, name, dst, filename, report)
 		return ast.GoToNext
 	}
 	_ = ast.Walk(doc, ast.NodeVisitorFunc(walkFn))
-	if hadErrors {
-		return errDirtyRun
+	return diags, nil
+}
+
+// checkResolved runs a link's destination through res, reporting a
+// broken-file diagnostic if it doesn't exist, or a broken-fragment/
+// unstable-slug diagnostic if its fragment doesn't resolve. dst is the
+// destination as written (used for diagnostics); loc is what's actually
+// passed to res (a joined filesystem path for the fs resolvers, the raw URL
+// for everything else).
+func checkResolved(res Resolver, u *url.URL, name, dst, loc string, report func(kind diagKind, dst string, fails bool, format string, args ...interface{})) {
+	ok, err := res.Exists(loc)
+	if err != nil {
+		report(kindBrokenFile, dst, true, "%s: %q: %v", name, dst, err)
+		return
+	}
+	if !ok {
+		report(kindBrokenFile, dst, true, "%s: %q: broken link", name, dst)
+		return
+	}
+	if u.Fragment == "" {
+		return
+	}
+	frags, err := res.Fragments(loc)
+	if err != nil {
+		return
+	}
+	if _, ok := frags[u.Fragment]; !ok {
+		report(kindBrokenFragment, dst, true, "%s: %q: broken link (fragment points to non-existent id)", name, dst)
+	} else if unstableRef(u.Fragment, frags) {
+		report(kindUnstableSlug, dst, false, unstableSlugFormat, name, dst)
+	}
+}
+
+// lineIndex maps byte offsets within a file to 1-based line/column pairs,
+// given the byte offsets of that file's newlines.
+type lineIndex []int
+
+func newLineIndex(b []byte) lineIndex {
+	var li lineIndex
+	for i, c := range b {
+		if c == '\n' {
+			li = append(li, i)
+		}
+	}
+	return li
+}
+
+func (li lineIndex) lineCol(offset int) (line, col int) {
+	n := sort.Search(len(li), func(i int) bool { return li[i] >= offset })
+	if n == 0 {
+		return 1, offset + 1
 	}
-	return nil
+	return n + 1, offset - li[n-1]
 }
 
 // unstableRef checks whether s looks something like "value-1" and allRefs also
@@ -221,15 +433,463 @@ func extractRefs(doc ast.Node) map[string]struct{} {
 	return idRefs
 }
 
-func fileRefs(name string) (map[string]struct{}, error) {
+func fileRefs(name string, cache *linkCache) (map[string]struct{}, error) {
 	b, err := ioutil.ReadFile(name)
 	if err != nil {
 		return nil, err
 	}
-	return extractRefs(parser.NewWithExtensions(extensions).Parse(b)), nil
+	if refs, ok := cache.get(name, b); ok {
+		return refs, nil
+	}
+	doc := parser.NewWithExtensions(extensions).Parse(b)
+	refs := extractRefs(doc)
+	cache.put(name, b, refs, extractLinks(doc))
+	return refs, nil
+}
+
+// extractLinks returns the destination of every link and image in doc, in
+// document order. It's stored in the link cache alongside a file's id set;
+// this program does not read the stored list back.
+func extractLinks(doc ast.Node) []string {
+	var out []string
+	_ = ast.Walk(doc, ast.NodeVisitorFunc(func(node ast.Node, entering bool) ast.WalkStatus {
+		if !entering {
+			return ast.GoToNext
+		}
+		switch n := node.(type) {
+		case *ast.Link:
+			out = append(out, string(n.Destination))
+		case *ast.Image:
+			out = append(out, string(n.Destination))
+		}
+		return ast.GoToNext
+	}))
+	return out
+}
+
+// Resolver checks whether a link destination exists, and what fragment ids
+// it exposes. It exists so processFile doesn't have to hardcode filesystem
+// semantics for every kind of destination a markdown file might link to.
+type Resolver interface {
+	// Exists reports whether dst exists.
+	Exists(dst string) (bool, error)
+	// Fragments returns the set of fragment ids dst exposes, for
+	// validating "dst#id" links. It's only meaningful to call once Exists
+	// has confirmed dst exists; resolvers that can't enumerate fragments
+	// may just return (nil, nil).
+	Fragments(dst string) (map[string]struct{}, error)
+}
+
+// resolverRegistry picks the Resolver responsible for a given link: the
+// filesystem (this program's original behavior) for relative, schemeless
+// destinations, and the external resolver for http(s) links to allow-listed
+// hosts. Other absolute destinations get no resolver and are not checked.
+type resolverRegistry struct {
+	anchors  anchorsManifest
+	hosts    map[string]bool
+	external Resolver
+}
+
+// forLocal returns the resolver for a relative, schemeless destination,
+// which is always checked against the local filesystem.
+func (r *resolverRegistry) forLocal(intrefs *safeRefMap, cache *linkCache, isImage bool) Resolver {
+	fs := &fsResolver{intrefs: intrefs, cache: cache, anchors: r.anchors}
+	if isImage {
+		return fsImageResolver{fs}
+	}
+	return fs
+}
+
+// forURL returns the resolver for an absolute destination, or nil if no
+// resolver is configured for it (in which case it's left unchecked, as it
+// always has been for links this program doesn't understand).
+func (r *resolverRegistry) forURL(u *url.URL) Resolver {
+	if r.external == nil || (u.Scheme != "http" && u.Scheme != "https") || !r.hosts[u.Host] {
+		return nil
+	}
+	return r.external
+}
+
+// fsResolver implements Resolver against the local filesystem: it's this
+// program's original behavior, expressed as a Resolver so it can sit in the
+// registry alongside resolvers for other kinds of destinations. dst is
+// expected to already be resolved relative to the referencing file, as
+// processFile has always done before checking a destination.
+type fsResolver struct {
+	intrefs *safeRefMap
+	cache   *linkCache
+	anchors anchorsManifest
+}
+
+func (r *fsResolver) Exists(dst string) (bool, error) { return fileOrDirExists(dst), nil }
+
+func (r *fsResolver) Fragments(dst string) (map[string]struct{}, error) {
+	if !strings.HasSuffix(dst, ".md") {
+		return nil, nil
+	}
+	if known, _ := r.intrefs.hasRef(dst, ""); known {
+		return r.intrefs.get(dst), nil
+	}
+	refs, err := fileRefs(dst, r.cache)
+	if err != nil {
+		return nil, err
+	}
+	refs = mergeIDs(refs, r.anchors[dst])
+	r.intrefs.setRefs(dst, refs)
+	return refs, nil
+}
+
+// fsImageResolver is fsResolver with image semantics: images must point at
+// a regular file, not a directory.
+type fsImageResolver struct{ *fsResolver }
+
+func (r fsImageResolver) Exists(dst string) (bool, error) { return fileExists(dst), nil }
+
+// anchorsManifest maps a markdown file's path, as this program resolves it
+// (joined onto the referencing file's directory, e.g. "docs/dir/doc.md" for
+// a link to "dir/doc.md" from "docs/index.md"), to extra fragment ids it exposes beyond
+// what gomarkdown's AutoHeadingIDs finds. It's useful when ids are actually
+// assigned by a downstream renderer such as Hugo or docsify.
+type anchorsManifest map[string][]string
+
+func loadAnchorsManifest(path string) (anchorsManifest, error) {
+	if path == "" {
+		return nil, nil
+	}
+	b, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	var m anchorsManifest
+	if err := json.Unmarshal(b, &m); err != nil {
+		return nil, fmt.Errorf("parsing anchors manifest %s: %w", path, err)
+	}
+	return m, nil
+}
+
+// mergeIDs returns ids with extra unioned in, without mutating ids.
+func mergeIDs(ids map[string]struct{}, extra []string) map[string]struct{} {
+	if len(extra) == 0 {
+		return ids
+	}
+	out := make(map[string]struct{}, len(ids)+len(extra))
+	for id := range ids {
+		out[id] = struct{}{}
+	}
+	for _, id := range extra {
+		out[id] = struct{}{}
+	}
+	return out
+}
+
+// httpResolverConcurrency bounds how many outbound HTTP requests httpResolver
+// issues at once, independent of the -j worker pool size, since those
+// workers each check many local links for every external one.
+const httpResolverConcurrency = 4
+
+// maxFragmentFetchSize bounds how much of an external page's body
+// httpResolver.Fragments will read, so a huge or malicious response can't
+// exhaust memory.
+const maxFragmentFetchSize = 2 << 20
+
+// httpResolver implements Resolver against real http(s) servers. It's only
+// ever consulted for hosts explicitly named via -check-external: issuing
+// requests to arbitrary third-party hosts isn't something a link check
+// should do unless asked to.
+type httpResolver struct {
+	client *http.Client
+	sem    chan struct{}
+	cache  *etagCache
+}
+
+func newHTTPResolver(cache *etagCache) *httpResolver {
+	return &httpResolver{
+		client: &http.Client{Timeout: 10 * time.Second},
+		sem:    make(chan struct{}, httpResolverConcurrency),
+		cache:  cache,
+	}
+}
+
+func (r *httpResolver) Exists(dst string) (bool, error) {
+	r.sem <- struct{}{}
+	defer func() { <-r.sem }()
+	req, err := http.NewRequest(http.MethodHead, dst, nil)
+	if err != nil {
+		return false, err
+	}
+	resp, err := r.client.Do(req)
+	if err != nil {
+		return false, err
+	}
+	defer resp.Body.Close()
+	io.Copy(ioutil.Discard, resp.Body)
+	if resp.StatusCode == http.StatusMethodNotAllowed || resp.StatusCode == http.StatusNotImplemented {
+		resp2, err := r.client.Get(dst)
+		if err != nil {
+			return false, err
+		}
+		defer resp2.Body.Close()
+		io.Copy(ioutil.Discard, resp2.Body)
+		return resp2.StatusCode < 400, nil
+	}
+	return resp.StatusCode < 400, nil
+}
+
+// Fragments fetches dst's body (reusing the cached ETag, if any, via a
+// conditional GET) and harvests its name/id attributes the same way
+// extractRefsHTML does for embedded HTML in a local markdown file.
+func (r *httpResolver) Fragments(dst string) (map[string]struct{}, error) {
+	r.sem <- struct{}{}
+	defer func() { <-r.sem }()
+	cached, haveCached := r.cache.get(dst)
+	req, err := http.NewRequest(http.MethodGet, dst, nil)
+	if err != nil {
+		return nil, err
+	}
+	if haveCached && cached.ETag != "" {
+		req.Header.Set("If-None-Match", cached.ETag)
+	}
+	resp, err := r.client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode == http.StatusNotModified {
+		return idSet(cached.IDs), nil
+	}
+	if resp.StatusCode >= 400 {
+		io.Copy(ioutil.Discard, resp.Body)
+		return nil, fmt.Errorf("fetching %s: %s", dst, resp.Status)
+	}
+	body, err := ioutil.ReadAll(io.LimitReader(resp.Body, maxFragmentFetchSize))
+	if err != nil {
+		return nil, err
+	}
+	ids := extractRefsHTML(body)
+	r.cache.put(dst, resp.Header.Get("ETag"), ids)
+	return idSet(ids), nil
+}
+
+func idSet(ids []string) map[string]struct{} {
+	if len(ids) == 0 {
+		return nil
+	}
+	m := make(map[string]struct{}, len(ids))
+	for _, id := range ids {
+		m[id] = struct{}{}
+	}
+	return m
+}
+
+// etagCacheEntry is the on-disk record for one cached httpResolver fetch,
+// keyed by request URL.
+type etagCacheEntry struct {
+	ETag string
+	IDs  []string
+}
+
+// etagCache is an on-disk cache of etagCacheEntry values keyed by request
+// URL, so httpResolver doesn't re-fetch and re-parse an unchanged external
+// page on every run. It mirrors linkCache's on-disk format and
+// save-if-dirty behavior.
+type etagCache struct {
+	path    string
+	mu      sync.Mutex
+	entries map[string]etagCacheEntry
+	dirty   bool
+}
+
+func loadEtagCache(path string) (*etagCache, error) {
+	c := &etagCache{path: path, entries: make(map[string]etagCacheEntry)}
+	if path == "" {
+		return c, nil
+	}
+	b, err := ioutil.ReadFile(path)
+	if os.IsNotExist(err) {
+		return c, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	if err := json.Unmarshal(b, &c.entries); err != nil {
+		return nil, fmt.Errorf("parsing external cache %s: %w", path, err)
+	}
+	return c, nil
+}
+
+func (c *etagCache) get(url string) (etagCacheEntry, bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	e, ok := c.entries[url]
+	return e, ok
+}
+
+func (c *etagCache) put(url, etag string, ids []string) {
+	c.mu.Lock()
+	c.entries[url] = etagCacheEntry{ETag: etag, IDs: ids}
+	c.dirty = true
+	c.mu.Unlock()
+}
+
+// save writes the cache back to its path, if it was constructed with one
+// and anything was added to it since it was loaded.
+func (c *etagCache) save() error {
+	if c == nil || c.path == "" {
+		return nil
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if !c.dirty {
+		return nil
+	}
+	b, err := json.Marshal(c.entries)
+	if err != nil {
+		return err
+	}
+	tf, err := ioutil.TempFile(filepath.Dir(c.path), ".mdurlcheck-external-cache-")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tf.Name())
+	if _, err := tf.Write(b); err != nil {
+		tf.Close()
+		return err
+	}
+	if err := tf.Close(); err != nil {
+		return err
+	}
+	return os.Rename(tf.Name(), c.path)
+}
+
+// emit renders diags in the requested format: "text" writes one line per
+// diagnostic to stderr, matching the output this program has always
+// produced; "json" writes one JSON object per diagnostic to stdout; "sarif"
+// writes a single SARIF 2.1.0 log to stdout.
+func emit(format string, diags []diagnostic) error {
+	switch format {
+	case "json":
+		enc := json.NewEncoder(os.Stdout)
+		for _, d := range diags {
+			rec := struct {
+				File        string   `json:"file"`
+				Line        int      `json:"line"`
+				Column      int      `json:"column"`
+				Destination string   `json:"destination"`
+				Kind        diagKind `json:"kind"`
+			}{d.File, d.Line, d.Column, d.Destination, d.Kind}
+			if err := enc.Encode(rec); err != nil {
+				return err
+			}
+		}
+		return nil
+	case "sarif":
+		enc := json.NewEncoder(os.Stdout)
+		enc.SetIndent("", "  ")
+		return enc.Encode(buildSARIF(diags))
+	default:
+		for _, d := range diags {
+			fmt.Fprintln(os.Stderr, d.Message)
+		}
+		return nil
+	}
+}
+
+// sarifLog and its nested types are a minimal subset of the SARIF 2.1.0
+// schema, covering just what's needed to report one result per diagnostic
+// with a rule id and a file/line/column location.
+type sarifLog struct {
+	Schema  string     `json:"$schema"`
+	Version string     `json:"version"`
+	Runs    []sarifRun `json:"runs"`
+}
+
+type sarifRun struct {
+	Tool    sarifTool     `json:"tool"`
+	Results []sarifResult `json:"results"`
+}
+
+type sarifTool struct {
+	Driver sarifDriver `json:"driver"`
+}
+
+type sarifDriver struct {
+	Name  string      `json:"name"`
+	Rules []sarifRule `json:"rules"`
+}
+
+type sarifRule struct {
+	ID string `json:"id"`
+}
+
+type sarifResult struct {
+	RuleID    string             `json:"ruleId"`
+	Level     string             `json:"level"`
+	Message   sarifMessage       `json:"message"`
+	Locations []sarifLocationObj `json:"locations"`
+}
+
+type sarifMessage struct {
+	Text string `json:"text"`
 }
 
-var errDirtyRun = errors.New("some links are not ok")
+type sarifLocationObj struct {
+	PhysicalLocation sarifPhysicalLocation `json:"physicalLocation"`
+}
+
+type sarifPhysicalLocation struct {
+	ArtifactLocation sarifArtifactLocation `json:"artifactLocation"`
+	Region           sarifRegion           `json:"region"`
+}
+
+type sarifArtifactLocation struct {
+	URI string `json:"uri"`
+}
+
+type sarifRegion struct {
+	StartLine   int `json:"startLine"`
+	StartColumn int `json:"startColumn,omitempty"`
+}
+
+func buildSARIF(diags []diagnostic) sarifLog {
+	seenRules := make(map[string]bool)
+	var rules []sarifRule
+	var results []sarifResult
+	for _, d := range diags {
+		if d.Kind == "" {
+			continue
+		}
+		if !seenRules[string(d.Kind)] {
+			seenRules[string(d.Kind)] = true
+			rules = append(rules, sarifRule{ID: string(d.Kind)})
+		}
+		line := d.Line
+		if line == 0 {
+			line = 1
+		}
+		level := "warning"
+		if d.Fails {
+			level = "error"
+		}
+		results = append(results, sarifResult{
+			RuleID:  string(d.Kind),
+			Level:   level,
+			Message: sarifMessage{Text: d.Message},
+			Locations: []sarifLocationObj{{PhysicalLocation: sarifPhysicalLocation{
+				ArtifactLocation: sarifArtifactLocation{URI: filepath.ToSlash(d.File)},
+				Region:           sarifRegion{StartLine: line, StartColumn: d.Column},
+			}}},
+		})
+	}
+	sort.Slice(rules, func(i, j int) bool { return rules[i].ID < rules[j].ID })
+	return sarifLog{
+		Schema:  "https://raw.githubusercontent.com/oasis-tcs/sarif-spec/master/Schemata/sarif-schema-2.1.0.json",
+		Version: "2.1.0",
+		Runs: []sarifRun{{
+			Tool:    sarifTool{Driver: sarifDriver{Name: "mdurlcheck", Rules: rules}},
+			Results: results,
+		}},
+	}
+}
 
 func fileExists(name string) bool {
 	fi, err := os.Stat(name)
@@ -265,6 +925,165 @@ func (m refMap) hasRef(file, ref string) (bool, bool) {
 
 func (m refMap) setRefs(file string, refs map[string]struct{}) { m[file] = refs }
 
+// safeRefMap guards a refMap with a mutex so it can be shared by the worker
+// pool in run.
+type safeRefMap struct {
+	mu sync.Mutex
+	m  refMap
+}
+
+func newSafeRefMap() *safeRefMap { return &safeRefMap{m: make(refMap)} }
+
+func (s *safeRefMap) hasRef(file, ref string) (bool, bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.m.hasRef(file, ref)
+}
+
+func (s *safeRefMap) setRefs(file string, refs map[string]struct{}) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.m.setRefs(file, refs)
+}
+
+func (s *safeRefMap) get(file string) map[string]struct{} {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.m[file]
+}
+
+// linkCacheEntry is the on-disk representation of everything extracted from
+// a single file, keyed by its content hash so a stale entry is detected
+// rather than trusted.
+type linkCacheEntry struct {
+	Hash  string   // sha256 hex of the file content this entry was derived from
+	Refs  []string // extracted heading/HTML ids
+	Links []string // outbound link/image destinations, as written
+}
+
+// linkCache is an on-disk cache of linkCacheEntry values keyed by absolute,
+// cleaned file path, modeled after content-hash caches like buildkit's: a
+// cache hit requires both the path and its recorded content hash to match.
+// It's safe for concurrent use by multiple worker goroutines.
+type linkCache struct {
+	path    string
+	mu      sync.Mutex
+	entries map[string]linkCacheEntry
+	dirty   bool
+}
+
+// loadLinkCache loads the cache from path, or returns an empty, unusable-
+// until-populated cache if path is empty or doesn't exist yet.
+func loadLinkCache(path string) (*linkCache, error) {
+	c := &linkCache{path: path, entries: make(map[string]linkCacheEntry)}
+	if path == "" {
+		return c, nil
+	}
+	b, err := ioutil.ReadFile(path)
+	if os.IsNotExist(err) {
+		return c, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	if err := json.Unmarshal(b, &c.entries); err != nil {
+		return nil, fmt.Errorf("parsing cache %s: %w", path, err)
+	}
+	return c, nil
+}
+
+// save writes the cache back to its path, if it was constructed with one and
+// anything was added to it since it was loaded.
+func (c *linkCache) save() error {
+	if c == nil || c.path == "" {
+		return nil
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if !c.dirty {
+		return nil
+	}
+	b, err := json.Marshal(c.entries)
+	if err != nil {
+		return err
+	}
+	tf, err := ioutil.TempFile(filepath.Dir(c.path), ".mdurlcheck-cache-")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tf.Name())
+	if _, err := tf.Write(b); err != nil {
+		tf.Close()
+		return err
+	}
+	if err := tf.Close(); err != nil {
+		return err
+	}
+	return os.Rename(tf.Name(), c.path)
+}
+
+// get returns the cached id set for name, provided its content still hashes
+// to what was recorded for it.
+func (c *linkCache) get(name string, content []byte) (map[string]struct{}, bool) {
+	if c == nil {
+		return nil, false
+	}
+	key, err := cacheKey(name)
+	if err != nil {
+		return nil, false
+	}
+	hash := hashHex(content)
+	c.mu.Lock()
+	e, ok := c.entries[key]
+	c.mu.Unlock()
+	if !ok || e.Hash != hash {
+		return nil, false
+	}
+	if len(e.Refs) == 0 {
+		return nil, true
+	}
+	refs := make(map[string]struct{}, len(e.Refs))
+	for _, s := range e.Refs {
+		refs[s] = struct{}{}
+	}
+	return refs, true
+}
+
+// put records the derived refs and links for name's current content.
+func (c *linkCache) put(name string, content []byte, refs map[string]struct{}, links []string) {
+	if c == nil {
+		return
+	}
+	key, err := cacheKey(name)
+	if err != nil {
+		return
+	}
+	e := linkCacheEntry{Hash: hashHex(content), Links: links}
+	if len(refs) > 0 {
+		e.Refs = make([]string, 0, len(refs))
+		for s := range refs {
+			e.Refs = append(e.Refs, s)
+		}
+	}
+	c.mu.Lock()
+	c.entries[key] = e
+	c.dirty = true
+	c.mu.Unlock()
+}
+
+func cacheKey(name string) (string, error) {
+	abs, err := filepath.Abs(name)
+	if err != nil {
+		return "", err
+	}
+	return filepath.Clean(abs), nil
+}
+
+func hashHex(b []byte) string {
+	sum := sha256.Sum256(b)
+	return hex.EncodeToString(sum[:])
+}
+
 // extractRefsHTML takes piece of html markup, parses it and returns values of
 // any name or id attributes found.
 func extractRefsHTML(b []byte) []string {
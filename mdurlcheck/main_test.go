@@ -0,0 +1,77 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"io"
+	"os"
+	"testing"
+)
+
+// captureStdout redirects os.Stdout for the duration of fn and returns
+// everything written to it.
+func captureStdout(t *testing.T, fn func()) []byte {
+	t.Helper()
+	r, w, err := os.Pipe()
+	if err != nil {
+		t.Fatal(err)
+	}
+	orig := os.Stdout
+	os.Stdout = w
+	defer func() { os.Stdout = orig }()
+	fn()
+	w.Close()
+	out, err := io.ReadAll(r)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return out
+}
+
+func TestEmitJSON(t *testing.T) {
+	diags := []diagnostic{
+		{File: "doc.md", Line: 3, Column: 5, Destination: "missing.md", Kind: kindBrokenFile, Message: "doc.md: broken link", Fails: true},
+	}
+	out := captureStdout(t, func() {
+		if err := emit("json", diags); err != nil {
+			t.Fatal(err)
+		}
+	})
+	var rec struct {
+		File        string   `json:"file"`
+		Line        int      `json:"line"`
+		Column      int      `json:"column"`
+		Destination string   `json:"destination"`
+		Kind        diagKind `json:"kind"`
+	}
+	if err := json.Unmarshal(bytes.TrimSpace(out), &rec); err != nil {
+		t.Fatalf("unmarshal %q: %v", out, err)
+	}
+	if rec.File != "doc.md" || rec.Line != 3 || rec.Column != 5 || rec.Destination != "missing.md" || rec.Kind != kindBrokenFile {
+		t.Errorf("got %+v, want file=doc.md line=3 column=5 destination=missing.md kind=%s", rec, kindBrokenFile)
+	}
+}
+
+func TestBuildSARIF(t *testing.T) {
+	diags := []diagnostic{
+		{File: "doc.md", Line: 1, Destination: "", Kind: kindBrokenFile, Message: "doc.md: empty url", Fails: false},
+		{File: "doc.md", Line: 2, Destination: "missing.md", Kind: kindBrokenFragment, Message: "doc.md: broken link", Fails: true},
+	}
+	log := buildSARIF(diags)
+	if log.Schema == "" || log.Version != "2.1.0" {
+		t.Fatalf("unexpected schema/version: %+v", log)
+	}
+	if len(log.Runs) != 1 {
+		t.Fatalf("got %d runs, want 1", len(log.Runs))
+	}
+	results := log.Runs[0].Results
+	if len(results) != len(diags) {
+		t.Fatalf("got %d results, want %d", len(results), len(diags))
+	}
+	if results[0].Level != "warning" {
+		t.Errorf("non-failing diagnostic: got level %q, want %q", results[0].Level, "warning")
+	}
+	if results[1].Level != "error" {
+		t.Errorf("failing diagnostic: got level %q, want %q", results[1].Level, "error")
+	}
+}